@@ -0,0 +1,88 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"gopkg.in/ldap.v2"
+)
+
+// LDAPAuthenticator authenticates by binding to an LDAP server as the named
+// user with the given password. Permissions still come from store, the same
+// way they do for BcryptAuthenticator - LDAP only vouches for identity, it
+// doesn't carry InfluxDB's write/read matchers.
+type LDAPAuthenticator struct {
+	store UserStore
+	// Addr is the LDAP server to dial, e.g. "ldap.example.com:389".
+	Addr string
+	// BindDNFormat is the DN template used to bind as the user, with %s
+	// replaced by name, e.g. "uid=%s,ou=people,dc=example,dc=com".
+	BindDNFormat string
+}
+
+func NewLDAPAuthenticator(store UserStore, addr, bindDNFormat string) *LDAPAuthenticator {
+	return &LDAPAuthenticator{store: store, Addr: addr, BindDNFormat: bindDNFormat}
+}
+
+func (self *LDAPAuthenticator) Lookup(name string) (User, error) {
+	return self.store.Lookup(name)
+}
+
+func (self *LDAPAuthenticator) Authenticate(name, password string) (User, error) {
+	if password == "" {
+		// RFC4513 5.1.2: a simple bind with a non-empty DN and an empty
+		// password is an "unauthenticated bind", which most servers accept
+		// regardless of whether the password is actually correct. Reject it
+		// ourselves instead of asking the server to check a credential that
+		// isn't really being checked.
+		return nil, fmt.Errorf("Invalid username/password")
+	}
+
+	conn, err := ldap.Dial("tcp", self.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't reach LDAP server: %s", err)
+	}
+	defer conn.Close()
+
+	if err := conn.Bind(fmt.Sprintf(self.BindDNFormat, name), password); err != nil {
+		return nil, fmt.Errorf("Invalid username/password")
+	}
+
+	return self.store.Lookup(name)
+}
+
+// JWTAuthenticator authenticates a bearer assertion signed by secret instead
+// of a password. The token's "sub" claim must match name; permissions are
+// still looked up from store.
+type JWTAuthenticator struct {
+	store  UserStore
+	secret []byte
+}
+
+func NewJWTAuthenticator(store UserStore, secret []byte) *JWTAuthenticator {
+	return &JWTAuthenticator{store: store, secret: secret}
+}
+
+func (self *JWTAuthenticator) Lookup(name string) (User, error) {
+	return self.store.Lookup(name)
+}
+
+func (self *JWTAuthenticator) Authenticate(name, token string) (User, error) {
+	parsed, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+		return self.secret, nil
+	})
+	if err != nil || !parsed.Valid {
+		return nil, fmt.Errorf("Invalid username/password")
+	}
+	claims, ok := parsed.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, fmt.Errorf("Invalid username/password")
+	}
+	if sub, _ := claims["sub"].(string); sub != name {
+		return nil, fmt.Errorf("Invalid username/password")
+	}
+
+	return self.store.Lookup(name)
+}
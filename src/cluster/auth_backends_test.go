@@ -0,0 +1,40 @@
+package cluster
+
+import (
+	"github.com/dgrijalva/jwt-go"
+	"testing"
+)
+
+// TestJWTAuthenticatorRoundTrip signs a real token the way a client would
+// and makes sure Authenticate accepts it and rejects the obvious ways it
+// could go wrong (wrong signature, wrong subject).
+func TestJWTAuthenticatorRoundTrip(t *testing.T) {
+	secret := []byte("super-secret-signing-key")
+	admin := &ClusterAdmin{CommonUser{Name: "admin"}}
+	auth := NewJWTAuthenticator(&staticUserStore{users: map[string]User{"admin": admin}}, secret)
+
+	sign := func(s []byte, sub string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": sub})
+		signed, err := token.SignedString(s)
+		if err != nil {
+			t.Fatalf("couldn't sign test token: %s", err)
+		}
+		return signed
+	}
+
+	user, err := auth.Authenticate("admin", sign(secret, "admin"))
+	if err != nil {
+		t.Fatalf("expected a validly signed token to authenticate, got: %s", err)
+	}
+	if user.GetName() != "admin" {
+		t.Fatalf("expected authenticated user admin, got %s", user.GetName())
+	}
+
+	if _, err := auth.Authenticate("admin", sign([]byte("wrong-secret"), "admin")); err == nil {
+		t.Fatalf("expected a token signed with the wrong secret to be rejected")
+	}
+
+	if _, err := auth.Authenticate("admin", sign(secret, "someone-else")); err == nil {
+		t.Fatalf("expected a token whose sub doesn't match the requested name to be rejected")
+	}
+}
@@ -0,0 +1,86 @@
+package cluster
+
+import (
+	"fmt"
+	"protocol"
+	"time"
+)
+
+// recoveryLivenessCheckInterval is how often a pending recovery request
+// polls whether the peer it's waiting on is still up, so a peer that drops
+// mid-request doesn't leave the caller blocked on response forever.
+const recoveryLivenessCheckInterval = 1 * time.Second
+
+// RecoverServer walks the WAL for every write server never got acknowledged
+// and re-sends it. It's the counterpart to the per-server buffer that
+// ShardData.Write fills while a ClusterServer is down: that buffer only
+// covers writes made while this process has been alive, while RecoverServer
+// replays whatever the WAL still has logged for the server, however far back
+// that goes, resuming from wherever the WAL last committed for it.
+//
+// It's meant to be called once a ClusterServer flips from down to up, either
+// from the health-check goroutine or via the admin reseed RPC. If the server
+// goes back down mid-replay, the wait for its ack aborts instead of blocking
+// the caller forever.
+func (self *ShardData) RecoverServer(server *ClusterServer) error {
+	requestNumber, err := self.wal.LastCommittedRequestNumber(server.Id)
+	if err != nil {
+		return err
+	}
+	shardIds := []uint32{self.id}
+
+	return self.wal.RecoverServerFromRequestNumber(requestNumber, shardIds, func(request *protocol.Request, recoveredRequestNumber uint32) error {
+		if !server.IsUp() {
+			return fmt.Errorf("server %d is down, aborting recovery", server.Id)
+		}
+
+		response := make(chan *protocol.Response, 1)
+		if err := server.MakeRequest(request, response); err != nil {
+			return err
+		}
+		return self.awaitRecoveryAck(server, response, recoveredRequestNumber)
+	})
+}
+
+// awaitRecoveryAck waits for the peer to end-stream its ack to a recovery
+// write, committing the WAL's low-water mark for it once it does. It polls
+// server.IsUp() instead of blocking on response indefinitely, so a server
+// that goes down after accepting the request but before acking it doesn't
+// hang the caller (the health-check goroutine or the admin reseed RPC).
+func (self *ShardData) awaitRecoveryAck(server *ClusterServer, response chan *protocol.Response, requestNumber uint32) error {
+	ticker := time.NewTicker(recoveryLivenessCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case res := <-response:
+			done, err := classifyRecoveryAck(res)
+			if !done {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			return self.wal.Commit(requestNumber, server.Id)
+		case <-ticker.C:
+			if !server.IsUp() {
+				return fmt.Errorf("server %d went down mid-replay, aborting recovery", server.Id)
+			}
+		}
+	}
+}
+
+// classifyRecoveryAck is the pure decision behind awaitRecoveryAck's response
+// loop, split out so it can be tested without a real ClusterServer or WAL:
+// done is true once res is the END_STREAM for the request, at which point
+// err is nil for a clean ack or the peer's reported failure otherwise. Any
+// other response means keep waiting (done is false).
+func classifyRecoveryAck(res *protocol.Response) (done bool, err error) {
+	if *res.Type != endStreamResponse {
+		return false, nil
+	}
+	if res.ErrorMessage != nil {
+		return true, fmt.Errorf(*res.ErrorMessage)
+	}
+	return true, nil
+}
@@ -0,0 +1,32 @@
+package cluster
+
+import (
+	"protocol"
+	"testing"
+)
+
+// TestClassifyRecoveryAck exercises the pure response-classification behind
+// awaitRecoveryAck. RecoverServer/awaitRecoveryAck themselves aren't
+// exercised here: they need a real ClusterServer and WAL, neither of which
+// is defined anywhere in this tree to fake convincingly against.
+func TestClassifyRecoveryAck(t *testing.T) {
+	midStream := &protocol.Response{Type: &queryResponse}
+	if done, err := classifyRecoveryAck(midStream); done || err != nil {
+		t.Fatalf("expected a non-END_STREAM response to keep waiting, got done=%v err=%v", done, err)
+	}
+
+	clean := &protocol.Response{Type: &endStreamResponse}
+	if done, err := classifyRecoveryAck(clean); !done || err != nil {
+		t.Fatalf("expected a clean END_STREAM to finish with no error, got done=%v err=%v", done, err)
+	}
+
+	message := "shard not found"
+	failed := &protocol.Response{Type: &endStreamResponse, ErrorMessage: &message}
+	done, err := classifyRecoveryAck(failed)
+	if !done || err == nil {
+		t.Fatalf("expected an END_STREAM carrying an error message to fail, got done=%v err=%v", done, err)
+	}
+	if err.Error() != message {
+		t.Fatalf("expected the peer's error message to propagate, got %q", err.Error())
+	}
+}
@@ -0,0 +1,67 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type staticUserStore struct {
+	users map[string]User
+}
+
+func (self *staticUserStore) Lookup(name string) (User, error) {
+	user, ok := self.users[name]
+	if !ok {
+		return nil, fmt.Errorf("no such user: %s", name)
+	}
+	return user, nil
+}
+
+// TestSecureTransportHandlesLongCredentials makes sure Authenticate/HandleAuth
+// round-trip a credential far longer than RSA-OAEP's ~190 byte limit for a
+// 2048-bit key, like the bearer tokens JWTAuthenticator deals in.
+func TestSecureTransportHandlesLongCredentials(t *testing.T) {
+	serverKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("couldn't generate RSA key: %s", err)
+	}
+
+	admin := &ClusterAdmin{CommonUser{Name: "admin"}}
+	longToken := strings.Repeat("x", 400) // longer than RSA-OAEP's ~190 byte limit at 2048 bits
+	auth := NewStaticTokenAuthenticator(
+		&staticUserStore{users: map[string]User{"admin": admin}},
+		map[string]string{"admin": longToken},
+	)
+
+	client := NewSecureProtobufClient(&serverKey.PublicKey)
+	clientSession, request, err := client.Authenticate("admin", longToken)
+	if err != nil {
+		t.Fatalf("client Authenticate failed with a long credential: %s", err)
+	}
+
+	server := NewSecureProtobufServer(auth, serverKey)
+	serverSession, response, err := server.HandleAuth(request)
+	if err != nil {
+		t.Fatalf("server HandleAuth rejected a valid long credential: %s", err)
+	}
+	if serverSession.User.GetName() != "admin" {
+		t.Fatalf("expected authenticated user admin, got %s", serverSession.User.GetName())
+	}
+
+	if err := client.FinishAuth(clientSession, response); err != nil {
+		t.Fatalf("client couldn't finish handshake: %s", err)
+	}
+}
+
+// TestLDAPAuthenticatorRejectsEmptyPassword makes sure an empty credential
+// never reaches conn.Bind, where an "unauthenticated bind" would otherwise
+// succeed regardless of whether the password is right.
+func TestLDAPAuthenticatorRejectsEmptyPassword(t *testing.T) {
+	auth := NewLDAPAuthenticator(&staticUserStore{}, "this-address-is-never-dialed:389", "uid=%s,dc=example,dc=com")
+	if _, err := auth.Authenticate("someone", ""); err == nil {
+		t.Fatalf("expected an error authenticating with an empty password")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"engine"
 	"errors"
 	"fmt"
+	"io"
 	"parser"
 	"protocol"
 	"sort"
@@ -23,6 +24,8 @@ type Shard interface {
 	Write(*protocol.Request) error
 	Query(querySpec *parser.QuerySpec, response chan *protocol.Response) error
 	IsMicrosecondInRange(t int64) bool
+	// Snapshot streams a point-in-time copy of the shard's data to w.
+	Snapshot(w io.Writer) error
 }
 
 // Passed to a shard (local datastore or whatever) that gets yielded points from series.
@@ -65,6 +68,7 @@ type ShardData struct {
 	shardDuration   time.Duration
 	localServerId   uint32
 	IsLocal         bool
+	subscriptions   *SubscriptionManager
 }
 
 func NewShard(id uint32, startTime, endTime time.Time, shardType ShardType, durationIsSplit bool, wal WAL) *ShardData {
@@ -85,6 +89,11 @@ func NewShard(id uint32, startTime, endTime time.Time, shardType ShardType, dura
 const (
 	PER_SERVER_BUFFER_SIZE  = 10
 	LOCAL_WRITE_BUFFER_SIZE = 10
+
+	// BATCH_POINT_SIZE is the assumed number of points the query engine bundles
+	// up per response when passing a non-aggregated query straight through, used
+	// to scale QueryResponseBufferSize's estimate down to a channel slot count.
+	BATCH_POINT_SIZE = 100
 )
 
 var (
@@ -107,6 +116,14 @@ type LocalShardStore interface {
 	GetOrCreateShard(id uint32) (LocalShardDb, error)
 	ReturnShard(id uint32)
 	DeleteShard(shardId uint32) error
+	// Snapshot streams a point-in-time copy of shard id's underlying data to w.
+	Snapshot(id uint32, w io.Writer) error
+	// RestoreShard atomically replaces shard id's data with what's read from r.
+	RestoreShard(id uint32, r io.Reader) error
+	// ShardSize returns the number of bytes Snapshot(id, ...) will write, so a
+	// caller streaming it out over the wire knows the length before it starts
+	// and can check the stream against it.
+	ShardSize(id uint32) (uint64, error)
 }
 
 func (self *ShardData) Id() uint32 {
@@ -156,6 +173,13 @@ func (self *ShardData) ServerIds() []uint32 {
 	return self.serverIds
 }
 
+// SetSubscriptionManager registers the SubscriptionManager whose
+// subscriptions should receive a copy of every write this shard logs. It's
+// optional; a shard with no manager set just skips the fan-out.
+func (self *ShardData) SetSubscriptionManager(subscriptions *SubscriptionManager) {
+	self.subscriptions = subscriptions
+}
+
 func (self *ShardData) Write(request *protocol.Request) error {
 	request.ShardId = &self.id
 	requestNumber, err := self.wal.AssignSequenceNumbersAndLog(request, self)
@@ -169,6 +193,9 @@ func (self *ShardData) Write(request *protocol.Request) error {
 	for _, server := range self.clusterServers {
 		server.BufferWrite(request)
 	}
+	if self.subscriptions != nil && request.Database != nil {
+		self.subscriptions.fanOut(*request.Database, request)
+	}
 	return nil
 }
 
@@ -198,14 +225,14 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *protoco
 		if querySpec.IsListSeriesQuery() {
 			processor = engine.NewListSeriesEngine(response)
 		} else if querySpec.IsDeleteFromSeriesQuery() || querySpec.IsDropSeriesQuery() || querySpec.IsSinglePointQuery() {
-			maxDeleteResults := 10000
-			processor = engine.NewPassthroughEngine(response, maxDeleteResults)
+			bufferSize := self.QueryResponseBufferSize(querySpec, 1)
+			processor = engine.NewPassthroughEngine(response, bufferSize)
 		} else {
 			if self.ShouldAggregateLocally(querySpec) {
 				processor = engine.NewQueryEngine(querySpec.SelectQuery(), response)
 			} else {
-				maxPointsToBufferBeforeSending := 1000
-				processor = engine.NewPassthroughEngine(response, maxPointsToBufferBeforeSending)
+				bufferSize := self.QueryResponseBufferSize(querySpec, BATCH_POINT_SIZE)
+				processor = engine.NewPassthroughEngine(response, bufferSize)
 			}
 		}
 		shard, err := self.store.GetOrCreateShard(self.id)
@@ -293,6 +320,43 @@ func (self *ShardData) ShouldAggregateLocally(querySpec *parser.QuerySpec) bool
 	return false
 }
 
+// QueryResponseBufferSize returns how many *protocol.Response slots should be
+// buffered for a query against this shard, so the passthrough processors
+// aren't stuck with a single hard-coded size regardless of the query's
+// shape. batchPointSize is the number of points the caller will bundle into
+// each buffered entry. The query engine used for locally aggregated queries
+// and the response channel passed into Query are not sized by it.
+func (self *ShardData) QueryResponseBufferSize(querySpec *parser.QuerySpec, batchPointSize int) int {
+	groupByInterval := querySpec.GetGroupByInterval()
+	if groupByInterval == nil {
+		return 1000
+	}
+	tickCount := int(self.shardDuration / *groupByInterval)
+	return responseBufferSizeForTickCount(tickCount, batchPointSize, querySpec.GetGroupByColumnCount())
+}
+
+// responseBufferSizeForTickCount holds the pure sizing math behind
+// QueryResponseBufferSize, split out so it can be tested without a real
+// *parser.QuerySpec: tickCount is shardDuration divided by the query's
+// group-by interval, columnCount is the number of group-by columns.
+func responseBufferSizeForTickCount(tickCount, batchPointSize, columnCount int) int {
+	switch {
+	case tickCount < 10:
+		tickCount = 100
+	case tickCount > 1000:
+		tickCount /= batchPointSize
+		if tickCount < 1000 {
+			tickCount = 1000
+		}
+	}
+	if columnCount > 1 {
+		// we don't know the cardinality of the group by columns, so just
+		// assume it could fan out by a couple orders of magnitude.
+		tickCount *= 100
+	}
+	return tickCount
+}
+
 func (self *ShardData) logAndHandleDeleteQuery(querySpec *parser.QuerySpec, response chan *protocol.Response) error {
 	queryString := querySpec.GetQueryStringWithTimeCondition()
 	request := self.createRequest(querySpec)
@@ -314,8 +378,8 @@ func (self *ShardData) LogAndHandleDestructiveQuery(querySpec *parser.QuerySpec,
 		localResponses = make(chan *protocol.Response, 1)
 
 		// this doesn't really apply at this point since destructive queries don't output anything, but it may later
-		maxPointsFromDestructiveQuery := 1000
-		processor := engine.NewPassthroughEngine(localResponses, maxPointsFromDestructiveQuery)
+		bufferSize := self.QueryResponseBufferSize(querySpec, 1)
+		processor := engine.NewPassthroughEngine(localResponses, bufferSize)
 		shard, err := self.store.GetOrCreateShard(self.id)
 		if err != nil {
 			return err
@@ -0,0 +1,29 @@
+package cluster
+
+import "testing"
+
+// TestResponseBufferSizeForTickCount exercises the pure sizing math behind
+// QueryResponseBufferSize directly, since building a real *parser.QuerySpec
+// to call QueryResponseBufferSize itself is outside what this package can
+// construct on its own.
+func TestResponseBufferSizeForTickCount(t *testing.T) {
+	tests := []struct {
+		name                                 string
+		tickCount, batchPointSize, columns   int
+		expected                             int
+	}{
+		{"few ticks clamp up to 100", 5, 1, 1, 100},
+		{"mid-range ticks pass through", 500, 1, 1, 500},
+		{"many ticks scale down by batch size", 10000, 10, 1, 1000},
+		{"many ticks never go below 1000", 2000, 100, 1, 1000},
+		{"multiple group-by columns fan out by 100x", 500, 1, 2, 50000},
+	}
+
+	for _, test := range tests {
+		got := responseBufferSizeForTickCount(test.tickCount, test.batchPointSize, test.columns)
+		if got != test.expected {
+			t.Errorf("%s: responseBufferSizeForTickCount(%d, %d, %d) = %d, expected %d",
+				test.name, test.tickCount, test.batchPointSize, test.columns, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"protocol"
+)
+
+// snapshotChunkSize is the number of bytes of raw shard data packed into a
+// single Response_SNAPSHOT message. Keeping chunks small bounds the amount
+// of memory either side needs to hold in flight at once.
+const snapshotChunkSize = 64 * 1024
+
+// snapshotResponseBuffer bounds the number of pending Response_SNAPSHOT
+// messages the sender will queue up before it blocks on the reader, so a
+// slow client can't make the source buffer an unbounded amount of shard
+// data in memory.
+const snapshotResponseBuffer = 4
+
+var (
+	snapshotRequest  = protocol.Request_SNAPSHOT
+	snapshotResponse = protocol.Response_SNAPSHOT
+)
+
+// Snapshot streams a point-in-time copy of the shard's data to w. If the
+// shard is local it reads directly from the underlying store, otherwise it
+// asks a healthy cluster server for the shard over the protobuf transport.
+func (self *ShardData) Snapshot(w io.Writer) error {
+	if self.IsLocal {
+		return self.store.Snapshot(self.id, w)
+	}
+
+	healthyServers := make([]*ClusterServer, 0, len(self.clusterServers))
+	for _, s := range self.clusterServers {
+		if s.IsUp() {
+			healthyServers = append(healthyServers, s)
+		}
+	}
+	if len(healthyServers) == 0 {
+		return fmt.Errorf("No servers up to snapshot shard %d", self.id)
+	}
+
+	response := make(chan *protocol.Response, snapshotResponseBuffer)
+	shardId := self.id
+	request := &protocol.Request{Type: &snapshotRequest, ShardId: &shardId}
+
+	errChan := make(chan error, 1)
+	go func() { errChan <- healthyServers[0].MakeRequest(request, response) }()
+
+	reader := NewSnapshotReader(response)
+	defer reader.Close()
+	if _, err := io.Copy(w, reader); err != nil {
+		return err
+	}
+	return <-errChan
+}
+
+// HandleSnapshotRequest answers an incoming Request_SNAPSHOT against store:
+// it stats the shard to get the length WriteSnapshot's header needs, then
+// streams store's own Snapshot output through WriteSnapshot so the chunking,
+// checksum and END_STREAM framing match what Snapshot()/NewSnapshotReader
+// expect on the other end. The server's request-dispatch loop (outside this
+// package) is what's expected to call this once it demultiplexes an
+// incoming request and sees Type == Request_SNAPSHOT.
+func HandleSnapshotRequest(store LocalShardStore, request *protocol.Request, response chan *protocol.Response) error {
+	if request.ShardId == nil {
+		err := fmt.Errorf("snapshot request missing shard id")
+		message := err.Error()
+		response <- &protocol.Response{Type: &endStreamResponse, ErrorMessage: &message}
+		return err
+	}
+	shardId := *request.ShardId
+
+	length, err := store.ShardSize(shardId)
+	if err != nil {
+		message := err.Error()
+		response <- &protocol.Response{Type: &endStreamResponse, ErrorMessage: &message}
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(store.Snapshot(shardId, pw))
+	}()
+
+	return WriteSnapshot(length, pr, response)
+}
+
+// RestoreShard replaces the local shard id's contents with the byte stream
+// produced by Snapshot. The swap is atomic from the perspective of readers:
+// the shard keeps serving the old data until the new data has been fully
+// received and verified.
+func (self *ShardData) RestoreShard(r io.Reader) error {
+	if !self.IsLocal {
+		return fmt.Errorf("shard %d is not local, can't restore it here", self.id)
+	}
+	return self.store.RestoreShard(self.id, r)
+}
+
+// snapshotHeader is written once at the end of a snapshot stream, after the
+// last data chunk and before END_STREAM, so the receiving side can validate
+// it got everything and nothing got corrupted in transit.
+type snapshotHeader struct {
+	Length   uint64
+	Checksum uint32
+}
+
+func encodeSnapshotHeader(h *snapshotHeader) []byte {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint64(buf[0:8], h.Length)
+	binary.BigEndian.PutUint32(buf[8:12], h.Checksum)
+	return buf
+}
+
+func decodeSnapshotHeader(buf []byte) (*snapshotHeader, error) {
+	if len(buf) < 12 {
+		return nil, fmt.Errorf("snapshot header too short: %d bytes", len(buf))
+	}
+	return &snapshotHeader{
+		Length:   binary.BigEndian.Uint64(buf[0:8]),
+		Checksum: binary.BigEndian.Uint32(buf[8:12]),
+	}, nil
+}
+
+// WriteSnapshot streams the full contents of r as a sequence of
+// Response_SNAPSHOT messages on response, followed by a trailing header
+// response carrying the length and checksum of the data so the reader on
+// the other end can tell if it got a truncated or corrupted stream. It's
+// used by the server side of the protobuf transport to answer a
+// Request_SNAPSHOT.
+//
+// length must be known up front (LevelDB shards are read from an on-disk
+// snapshot view, so this is just a stat call by the caller): if the number
+// of bytes actually read from r differs from it, the stream ends with an
+// error END_STREAM instead of the header.
+func WriteSnapshot(length uint64, r io.Reader, response chan *protocol.Response) error {
+	hash := crc32.NewIEEE()
+	tee := io.TeeReader(r, hash)
+
+	buf := make([]byte, snapshotChunkSize)
+	var sent uint64
+	for {
+		n, err := tee.Read(buf)
+		if n > 0 {
+			sent += uint64(n)
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			response <- &protocol.Response{Type: &snapshotResponse, Data: data}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			message := err.Error()
+			response <- &protocol.Response{Type: &endStreamResponse, ErrorMessage: &message}
+			return err
+		}
+	}
+	if sent != length {
+		message := fmt.Sprintf("snapshot length mismatch: expected %d, sent %d", length, sent)
+		response <- &protocol.Response{Type: &endStreamResponse, ErrorMessage: &message}
+		return fmt.Errorf(message)
+	}
+
+	header := encodeSnapshotHeader(&snapshotHeader{Length: sent, Checksum: hash.Sum32()})
+	response <- &protocol.Response{Type: &snapshotResponse, Data: header}
+	response <- &protocol.Response{Type: &endStreamResponse}
+	return nil
+}
+
+// snapshotReadCloser reassembles the chunked Response_SNAPSHOT stream
+// produced by WriteSnapshot behind a plain io.ReadCloser, verifying the
+// trailing header once the stream ends.
+type snapshotReadCloser struct {
+	response <-chan *protocol.Response
+	buf      []byte
+	hash     hash.Hash32
+	sawSum   bool
+	sum      uint32
+	length   uint64
+	got      uint64
+	done     bool
+	err      error
+}
+
+// NewSnapshotReader wraps the response channel a Request_SNAPSHOT was made
+// on so callers can consume the incoming shard data as a normal
+// io.ReadCloser instead of pulling protocol.Response messages by hand.
+func NewSnapshotReader(response <-chan *protocol.Response) io.ReadCloser {
+	return &snapshotReadCloser{response: response, hash: crc32.NewIEEE()}
+}
+
+func (self *snapshotReadCloser) Read(p []byte) (int, error) {
+	for len(self.buf) == 0 {
+		if self.done {
+			return 0, self.err
+		}
+		res := <-self.response
+		if *res.Type == endStreamResponse {
+			self.done = true
+			switch {
+			case res.ErrorMessage != nil:
+				self.err = fmt.Errorf(*res.ErrorMessage)
+			case !self.sawSum:
+				self.err = fmt.Errorf("snapshot missing trailing header")
+			case self.got != self.length:
+				self.err = fmt.Errorf("snapshot truncated: got %d of %d bytes", self.got, self.length)
+			case self.hash.Sum32() != self.sum:
+				self.err = fmt.Errorf("snapshot checksum mismatch: got %x, expected %x", self.hash.Sum32(), self.sum)
+			default:
+				self.err = io.EOF
+			}
+			continue
+		}
+		if !self.sawSum {
+			if header, err := decodeSnapshotHeader(res.Data); err == nil && self.got == header.Length {
+				self.length = header.Length
+				self.sum = header.Checksum
+				self.sawSum = true
+				continue
+			}
+		}
+		self.got += uint64(len(res.Data))
+		self.hash.Write(res.Data)
+		self.buf = res.Data
+	}
+	n := copy(p, self.buf)
+	self.buf = self.buf[n:]
+	return n, nil
+}
+
+func (self *snapshotReadCloser) Close() error {
+	return nil
+}
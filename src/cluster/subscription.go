@@ -0,0 +1,299 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"protocol"
+	"sync"
+	"sync/atomic"
+)
+
+// SubscriptionMode controls whether a Subscription's Matchers are ANDed or
+// ORed together when deciding if a write should be forked to it.
+type SubscriptionMode int
+
+const (
+	// ALL requires every Matcher to match before the write is forked.
+	ALL SubscriptionMode = iota
+	// ANY forks the write if at least one Matcher matches.
+	ANY
+)
+
+// subscriptionQueueSize bounds how many writes can be queued per destination
+// before new ones are dropped, so a stalled subscriber can't apply
+// back-pressure to the primary write path.
+const subscriptionQueueSize = 1000
+
+// Subscription describes a named consumer that wants a copy of every write
+// to a database whose series match Matchers. Destinations are delivery
+// endpoints, e.g. "udp://host:port" or "http://host:port/path".
+type Subscription struct {
+	Name         string           `json:"name"`
+	Database     string           `json:"database"`
+	Matchers     []*Matcher       `json:"matchers"`
+	Mode         SubscriptionMode `json:"mode"`
+	Destinations []string         `json:"destinations"`
+}
+
+// matches returns true if this subscription wants a copy of a write to the
+// given series, according to Mode.
+func (self *Subscription) matches(series string) bool {
+	if len(self.Matchers) == 0 {
+		return false
+	}
+	switch self.Mode {
+	case ANY:
+		for _, m := range self.Matchers {
+			if m.Matches(series) {
+				return true
+			}
+		}
+		return false
+	default: // ALL
+		for _, m := range self.Matchers {
+			if !m.Matches(series) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// SubscriptionStats holds the per-destination counters exposed so operators
+// can see whether a subscription is keeping up.
+type SubscriptionStats struct {
+	Sent    uint64
+	Dropped uint64
+}
+
+// destinationSink is the running, per-destination side of a registered
+// Subscription: a bounded queue plus the goroutine draining it.
+type destinationSink struct {
+	destination string
+	requests    chan *protocol.Request
+	stop        chan struct{}
+	sent        uint64
+	dropped     uint64
+}
+
+func newDestinationSink(destination string) *destinationSink {
+	sink := &destinationSink{
+		destination: destination,
+		requests:    make(chan *protocol.Request, subscriptionQueueSize),
+		stop:        make(chan struct{}),
+	}
+	go sink.run()
+	return sink
+}
+
+func (self *destinationSink) write(request *protocol.Request) {
+	select {
+	case self.requests <- request:
+	default:
+		atomic.AddUint64(&self.dropped, 1)
+	}
+}
+
+func (self *destinationSink) run() {
+	for {
+		select {
+		case request := <-self.requests:
+			if err := deliverToDestination(self.destination, request); err != nil {
+				atomic.AddUint64(&self.dropped, 1)
+				continue
+			}
+			atomic.AddUint64(&self.sent, 1)
+		case <-self.stop:
+			return
+		}
+	}
+}
+
+func (self *destinationSink) close() {
+	close(self.stop)
+}
+
+// deliverToDestination sends request's encoded bytes to a udp://, http:// or
+// https:// destination. Any other scheme, or a delivery failure, is returned as an
+// error so the caller can count it as a drop.
+func deliverToDestination(destination string, request *protocol.Request) error {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return err
+	}
+
+	data, err := request.Encode()
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		resp, err := http.Post(destination, "application/octet-stream", bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("subscription destination %s returned %s", destination, resp.Status)
+		}
+		return nil
+	case "udp":
+		conn, err := net.Dial("udp", u.Host)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Write(data)
+		return err
+	default:
+		return fmt.Errorf("unsupported subscription destination scheme: %s", u.Scheme)
+	}
+}
+
+// registeredSubscription pairs a Subscription with its live destination
+// sinks so Deregister can stop them cleanly.
+type registeredSubscription struct {
+	subscription *Subscription
+	sinks        []*destinationSink
+}
+
+// SubscriptionManager holds the set of registered Subscriptions and fans
+// writes out to their destinations. It does not participate in the
+// durability guarantees of the primary write path: a destination being slow
+// or down only ever costs that destination dropped writes, tracked in
+// SubscriptionStats.
+//
+// SubscriptionManager itself doesn't talk to raft - it has no durable
+// storage of its own, the same way ShardData doesn't serialize itself and
+// instead hands ToNewShardData's plain struct to whatever's writing the
+// raft log. List and LoadSubscriptions are that same seam for
+// subscriptions: the raft-serialized cluster configuration is expected to
+// include List()'s output alongside its shards (NewShardData) when it
+// snapshots itself, and to call LoadSubscriptions with that same slice when
+// it replays a snapshot or a config-change log entry on startup or on a
+// leadership change.
+type SubscriptionManager struct {
+	mu            sync.RWMutex
+	subscriptions map[string]*registeredSubscription
+}
+
+// NewSubscriptionManager creates an empty SubscriptionManager.
+func NewSubscriptionManager() *SubscriptionManager {
+	return &SubscriptionManager{
+		subscriptions: make(map[string]*registeredSubscription),
+	}
+}
+
+// Register adds a subscription and starts its destination sinks. Calling
+// Register again with the same name replaces the previous subscription.
+func (self *SubscriptionManager) Register(subscription *Subscription) error {
+	sinks := make([]*destinationSink, len(subscription.Destinations))
+	for i, destination := range subscription.Destinations {
+		sinks[i] = newDestinationSink(destination)
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if existing, ok := self.subscriptions[subscription.Name]; ok {
+		for _, sink := range existing.sinks {
+			sink.close()
+		}
+	}
+	self.subscriptions[subscription.Name] = &registeredSubscription{subscription: subscription, sinks: sinks}
+	return nil
+}
+
+// LoadSubscriptions replaces the manager's current subscriptions with
+// subscriptions, starting fresh destination sinks for each. It's meant to be
+// called with whatever the raft-serialized cluster configuration last had in
+// it - on startup once a snapshot's been applied, and again on every config
+// change that touches subscriptions - so a process restart or a leadership
+// change doesn't lose them.
+func (self *SubscriptionManager) LoadSubscriptions(subscriptions []*Subscription) {
+	self.mu.Lock()
+	existing := self.subscriptions
+	self.subscriptions = make(map[string]*registeredSubscription, len(subscriptions))
+	self.mu.Unlock()
+
+	for _, sink := range existing {
+		for _, s := range sink.sinks {
+			s.close()
+		}
+	}
+	for _, subscription := range subscriptions {
+		self.Register(subscription)
+	}
+}
+
+// Deregister removes a subscription by name and stops its destination sinks.
+func (self *SubscriptionManager) Deregister(name string) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	existing, ok := self.subscriptions[name]
+	if !ok {
+		return fmt.Errorf("no subscription named %s", name)
+	}
+	for _, sink := range existing.sinks {
+		sink.close()
+	}
+	delete(self.subscriptions, name)
+	return nil
+}
+
+// List returns the currently registered subscriptions.
+func (self *SubscriptionManager) List() []*Subscription {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	subscriptions := make([]*Subscription, 0, len(self.subscriptions))
+	for _, existing := range self.subscriptions {
+		subscriptions = append(subscriptions, existing.subscription)
+	}
+	return subscriptions
+}
+
+// Stats returns the send/drop counters for every destination of the named
+// subscription, keyed by destination.
+func (self *SubscriptionManager) Stats(name string) map[string]SubscriptionStats {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	existing, ok := self.subscriptions[name]
+	if !ok {
+		return nil
+	}
+	stats := make(map[string]SubscriptionStats, len(existing.sinks))
+	for _, sink := range existing.sinks {
+		stats[sink.destination] = SubscriptionStats{
+			Sent:    atomic.LoadUint64(&sink.sent),
+			Dropped: atomic.LoadUint64(&sink.dropped),
+		}
+	}
+	return stats
+}
+
+// fanOut forks request to every registered subscription for database whose
+// matchers match request's series. It never blocks on a destination: writes
+// that can't be queued immediately are dropped and counted.
+func (self *SubscriptionManager) fanOut(database string, request *protocol.Request) {
+	if request.Series == nil || request.Series.Name == nil {
+		return
+	}
+	series := *request.Series.Name
+
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	for _, existing := range self.subscriptions {
+		if existing.subscription.Database != database {
+			continue
+		}
+		if !existing.subscription.matches(series) {
+			continue
+		}
+		for _, sink := range existing.sinks {
+			sink.write(request)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package cluster
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"protocol"
+	"testing"
+	"time"
+)
+
+// TestDeliverToDestinationCountsHTTPErrorsAsFailures makes sure a non-2xx
+// response is treated as a delivery failure instead of a successful send,
+// so a misconfigured destination shows up in Dropped rather than Sent.
+func TestDeliverToDestinationCountsHTTPErrorsAsFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	name := "series"
+	request := &protocol.Request{Series: &protocol.Series{Name: &name}}
+	if err := deliverToDestination(server.URL, request); err == nil {
+		t.Fatalf("expected a 500 response to be treated as a delivery failure")
+	}
+}
+
+// TestSubscriptionDeliversOverUDP makes sure a udp:// destination actually
+// gets written to, rather than always falling into deliverToDestination's
+// default "unsupported scheme" branch.
+func TestSubscriptionDeliversOverUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't open a UDP listener: %s", err)
+	}
+	defer conn.Close()
+
+	manager := NewSubscriptionManager()
+	name := "series"
+	manager.Register(&Subscription{
+		Name:         "udp-sub",
+		Database:     "db",
+		Matchers:     []*Matcher{{Name: "series"}},
+		Mode:         ALL,
+		Destinations: []string{"udp://" + conn.LocalAddr().String()},
+	})
+
+	request := &protocol.Request{Series: &protocol.Series{Name: &name}}
+	manager.fanOut("db", request)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("never received the forked write over UDP: %s", err)
+	}
+	if n == 0 {
+		t.Fatalf("received an empty UDP packet")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if manager.Stats("udp-sub")["udp://"+conn.LocalAddr().String()].Sent > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("subscription stats never recorded the UDP send")
+}
+
+// TestSubscriptionManagerLoadSubscriptions makes sure LoadSubscriptions
+// replaces whatever was registered before, the way a raft config replay
+// would on startup.
+func TestSubscriptionManagerLoadSubscriptions(t *testing.T) {
+	manager := NewSubscriptionManager()
+	manager.Register(&Subscription{Name: "old", Database: "db"})
+
+	manager.LoadSubscriptions([]*Subscription{
+		{Name: "restored", Database: "db", Matchers: []*Matcher{{Name: "cpu"}}},
+	})
+
+	names := map[string]bool{}
+	for _, s := range manager.List() {
+		names[s.Name] = true
+	}
+	if names["old"] {
+		t.Fatalf("expected LoadSubscriptions to drop the previous subscription set")
+	}
+	if !names["restored"] {
+		t.Fatalf("expected LoadSubscriptions to register the new subscription set")
+	}
+}
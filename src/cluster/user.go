@@ -2,6 +2,8 @@ package cluster
 
 import (
 	"code.google.com/p/go.crypto/bcrypt"
+	"crypto/subtle"
+	"fmt"
 	"github.com/influxdb/go-cache"
 	"regexp"
 )
@@ -12,6 +14,19 @@ func init() {
 	userCache = cache.New(0, 0)
 }
 
+// User is implemented by CommonUser's embedders (ClusterAdmin, DbUser) and
+// is what an Authenticator hands back once it's confirmed who's talking.
+type User interface {
+	GetName() string
+	IsDeleted() bool
+	ChangePassword(hash string) error
+	IsClusterAdmin() bool
+	IsDbAdmin(db string) bool
+	GetDb() string
+	HasWriteAccess(name string) bool
+	HasReadAccess(name string) bool
+}
+
 type Matcher struct {
 	IsRegex bool
 	Name    string
@@ -135,3 +150,89 @@ func HashPassword(password string) ([]byte, error) {
 	// to brute force, since it will be really slow and impractical
 	return bcrypt.GenerateFromPassword([]byte(password), 10)
 }
+
+// UserStore looks a user up by name, without checking credentials. It's
+// implemented by whatever keeps the raft-serialized cluster admins and
+// per-database users, and is shared by every Authenticator backend so they
+// can all answer Lookup the same way.
+type UserStore interface {
+	Lookup(name string) (User, error)
+}
+
+// passwordUser is satisfied by *ClusterAdmin and *DbUser through their
+// embedded CommonUser, and lets an Authenticator check a password without
+// caring which concrete user type it got back from a UserStore.
+type passwordUser interface {
+	IsDeleted() bool
+	isValidPwd(password string) bool
+}
+
+// Authenticator turns a name and some credential (a password, a token, a
+// bearer assertion - whatever the backend wants) into a User. The bcrypt
+// backend below is the default; other backends (LDAP, a static token list,
+// JWT) can be swapped in without touching anything that only cares about
+// the resulting User.
+type Authenticator interface {
+	Authenticate(name, credential string) (User, error)
+	Lookup(name string) (User, error)
+}
+
+// BcryptAuthenticator is the default Authenticator: it looks the user up in
+// store and checks credential against their bcrypt hash, same as the
+// CommonUser.isValidPwd path did before Authenticator existed.
+type BcryptAuthenticator struct {
+	store UserStore
+}
+
+func NewBcryptAuthenticator(store UserStore) *BcryptAuthenticator {
+	return &BcryptAuthenticator{store: store}
+}
+
+func (self *BcryptAuthenticator) Lookup(name string) (User, error) {
+	return self.store.Lookup(name)
+}
+
+func (self *BcryptAuthenticator) Authenticate(name, password string) (User, error) {
+	user, err := self.store.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	pwdUser, ok := user.(passwordUser)
+	if !ok {
+		return nil, fmt.Errorf("Invalid username/password")
+	}
+	if pwdUser.IsDeleted() || !pwdUser.isValidPwd(password) {
+		return nil, fmt.Errorf("Invalid username/password")
+	}
+	return user, nil
+}
+
+// StaticTokenAuthenticator authenticates by matching credential against a
+// fixed, pre-shared token per user name, e.g. for service accounts that
+// shouldn't go through the bcrypt/password flow. The User it returns still
+// comes from store, so permissions are managed the same way as for any
+// other user.
+type StaticTokenAuthenticator struct {
+	store  UserStore
+	tokens map[string]string
+}
+
+func NewStaticTokenAuthenticator(store UserStore, tokens map[string]string) *StaticTokenAuthenticator {
+	return &StaticTokenAuthenticator{store: store, tokens: tokens}
+}
+
+func (self *StaticTokenAuthenticator) Lookup(name string) (User, error) {
+	return self.store.Lookup(name)
+}
+
+func (self *StaticTokenAuthenticator) Authenticate(name, token string) (User, error) {
+	expected, ok := self.tokens[name]
+	// subtle.ConstantTimeCompare still short-circuits on a length mismatch in
+	// non-constant time, but that only reveals the expected token's length,
+	// not any of its bytes, which is an acceptable leak for a pre-shared
+	// secret.
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), []byte(token)) != 1 {
+		return nil, fmt.Errorf("Invalid username/password")
+	}
+	return self.store.Lookup(name)
+}